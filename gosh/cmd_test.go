@@ -0,0 +1,99 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	InitChildMain()
+	os.Exit(m.Run())
+}
+
+var exitNowFunc = RegisterFunc("exitNowFunc", func() error {
+	return nil
+})
+
+var catFunc = RegisterFunc("catFunc", func() error {
+	_, err := io.Copy(os.Stdout, os.Stdin)
+	return err
+})
+
+// TestAwaitReadyAwaitVarsReturnOnExit verifies that AwaitReady and AwaitVars
+// return errProcessExited, rather than hanging forever, when the child exits
+// without ever calling SendReady or SendVars.
+func TestAwaitReadyAwaitVarsReturnOnExit(t *testing.T) {
+	sh := NewShell(t, nil)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(exitNowFunc)
+	c.Start()
+	if err := c.awaitReady(); err != errProcessExited {
+		t.Errorf("AwaitReady: got %v, want %v", err, errProcessExited)
+	}
+	c.Wait()
+
+	c = sh.FuncCmd(exitNowFunc)
+	c.Start()
+	if _, err := c.awaitVars("foo"); err != errProcessExited {
+		t.Errorf("AwaitVars: got %v, want %v", err, errProcessExited)
+	}
+	c.Wait()
+}
+
+// TestStdinPipeLargeWrite verifies that writing far more data than an OS
+// pipe's fixed-size buffer holds to StdinPipe doesn't deadlock, since writes
+// land in an unbounded BufferedPipe rather than the OS pipe itself.
+func TestStdinPipeLargeWrite(t *testing.T) {
+	sh := NewShell(t, nil)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(catFunc)
+	stdin := c.StdinPipe()
+	var stdout bytes.Buffer
+	c.AddStdoutWriter(&stdout)
+	c.Start()
+
+	want := bytes.Repeat([]byte("a"), 64<<20) // 64MiB, many times the OS pipe buffer size
+	done := make(chan error, 1)
+	go func() {
+		_, err := stdin.Write(want)
+		if cerr := stdin.Close(); err == nil {
+			err = cerr
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Write/Close on StdinPipe failed: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("timed out writing to StdinPipe; possible deadlock")
+	}
+	c.Wait()
+	if got, want := stdout.Len(), len(want); got != want {
+		t.Errorf("got %d bytes, want %d", got, want)
+	}
+}
+
+// TestTerminateRacesNormalExit repeatedly starts a child that exits
+// immediately and races Terminate against that exit, to catch "process
+// already finished" races in Cmd's signal/terminate handling.
+func TestTerminateRacesNormalExit(t *testing.T) {
+	sh := NewShell(t, nil)
+	defer sh.Cleanup()
+
+	for i := 0; i < 100; i++ {
+		c := sh.FuncCmd(exitNowFunc)
+		c.Start()
+		c.Terminate(os.Interrupt)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+type greetArgs struct {
+	Name  string
+	Times int
+}
+
+var greetFunc = RegisterFunc("greetFunc", func(n int, args greetArgs) error {
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(os.Stdout, "hello %s (%d)\n", args.Name, args.Times)
+	}
+	return nil
+})
+
+var ctxFunc = RegisterFunc("ctxFunc", func(ctx context.Context, msg string) error {
+	<-ctx.Done()
+	fmt.Fprintln(os.Stdout, msg)
+	return nil
+})
+
+// TestFuncCmdTypedArgs verifies that FuncCmd round-trips non-trivial typed
+// arguments (an int and a struct) to the registered function via its JSON
+// encoding, rather than requiring callers to hand-marshal strings.
+func TestFuncCmdTypedArgs(t *testing.T) {
+	sh := NewShell(t, nil)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(greetFunc, 2, greetArgs{Name: "world", Times: 3})
+	got := c.Stdout()
+	want := "hello world (3)\nhello world (3)\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestFuncCmdContextCanceledOnSignal verifies that a registered function
+// whose first parameter is a context.Context observes that context being
+// canceled when the child process is signaled.
+func TestFuncCmdContextCanceledOnSignal(t *testing.T) {
+	sh := NewShell(t, nil)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(ctxFunc, "done")
+	var stdout strings.Builder
+	c.AddStdoutWriter(&stdout)
+	c.Start()
+	c.Terminate(os.Interrupt)
+	if got, want := stdout.String(), "done\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestRegisterFuncPanicsOnDuplicateName verifies that RegisterFunc panics
+// when the same name is registered twice.
+func TestRegisterFuncPanicsOnDuplicateName(t *testing.T) {
+	RegisterFunc("duplicateNameFunc", func() error { return nil })
+	defer func() {
+		if recover() == nil {
+			t.Error("RegisterFunc did not panic on duplicate name")
+		}
+	}()
+	RegisterFunc("duplicateNameFunc", func() error { return nil })
+}
+
+// TestRegisterFuncPanicsOnWrongSignature verifies that RegisterFunc panics
+// when fn doesn't return exactly one error.
+func TestRegisterFuncPanicsOnWrongSignature(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("RegisterFunc did not panic on wrong signature")
+		}
+	}()
+	RegisterFunc("badFunc", func() (int, error) { return 0, nil })
+}